@@ -1,12 +1,13 @@
 package api
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/ledgerwatch/diagnostics"
@@ -14,13 +15,25 @@ import (
 	"github.com/ledgerwatch/diagnostics/internal/erigon_node"
 	"github.com/ledgerwatch/diagnostics/internal/sessions"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var _ http.Handler = &UIHandler{}
 
+// maxConsecutiveDecodeErrors bounds how many back-to-back failures to decode
+// a response are tolerated before the reader loop gives up on the
+// connection. Without this, a client that stops sending well-formed JSON
+// (rather than closing the connection) makes the loop spin forever.
+const maxConsecutiveDecodeErrors = 5
+
 type BridgeHandler struct {
 	chi.Router
-	cache sessions.CacheService
+	cache       sessions.CacheService
+	metrics     *bridgeMetrics
+	nodeStatus  *nodeStatusTracker
+	shutdownCtx context.Context
+	logger      *slog.Logger
 }
 
 func (h BridgeHandler) Bridge(w http.ResponseWriter, r *http.Request) {
@@ -31,29 +44,60 @@ func (h BridgeHandler) Bridge(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	defer r.Body.Close()
 
+	// Tear the connection down if the server is shutting down, even though
+	// the client hasn't disconnected yet.
+	go func() {
+		select {
+		case <-h.shutdownCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	// Update the request context with the connection context.
 	// If the connection is closed by the server, it will also notify everything that waits on the request context.
 	*r = *r.WithContext(ctx)
 
+	// The node advertises the transport it wants via Content-Type: the
+	// framed binary protocol, or the legacy newline-free JSON objects if
+	// unset or anything else.
+	useCBOR := isCBORTransport(r)
+	var frameReader *bufio.Reader
+	if useCBOR {
+		w.Header().Set("Content-Type", cborContentType)
+		frameReader = bufio.NewReader(r.Body)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
 	connectionInfo := struct {
-		Version  uint64               `json:"version"`
-		Sessions []string             `json:"sessions"`
-		Nodes    []*sessions.NodeInfo `json:"nodes"`
+		Version  uint64               `json:"version" cbor:"version"`
+		Sessions []string             `json:"sessions" cbor:"sessions"`
+		Nodes    []*sessions.NodeInfo `json:"nodes" cbor:"nodes"`
 	}{}
 
-	err := json.NewDecoder(r.Body).Decode(&connectionInfo)
+	err := decodeHandshake(useCBOR, r, frameReader, &connectionInfo)
 
 	if err != nil {
-		log.Printf("Error reading connection info: %v\n", err)
+		h.logger.Error("Error reading connection info", "error", err)
 		internal.EncodeError(w, r, diagnostics.AsBadRequestErr(errors.Errorf("Error reading connection info: %v", err)))
 		return
 	}
 
-	requestMap := map[string]*erigon_node.NodeRequest{}
-	requestMutex := sync.Mutex{}
+	dispatcher := newRequestDispatcher(h.metrics)
+
+	var wg sync.WaitGroup
+	dispatcher.runJanitor(ctx, &wg)
+
+	// Every node gets its own writer goroutine below, but they all write to
+	// the same w: writeMu serializes them so one frame's header and body
+	// (or one legacy JSON object) always lands on the wire as a unit rather
+	// than interleaving with another node's write mid-frame.
+	var writeMu sync.Mutex
+
+	h.metrics.activeSessions.Inc()
+	defer h.metrics.activeSessions.Dec()
 
 	for _, node := range connectionInfo.Nodes {
 		nodeSession, ok := h.cache.FindNodeSession(node.Id)
@@ -62,8 +106,9 @@ func (h BridgeHandler) Bridge(w http.ResponseWriter, r *http.Request) {
 			nodeSession, err = h.cache.CreateNodeSession(node)
 
 			if err != nil {
-				log.Printf("Error creating node session: %v\n", err)
-				internal.EncodeError(w, r, diagnostics.AsBadRequestErr(errors.Errorf("Error creating node session: %w", err)))
+				id := correlationID(connectionInfo.Sessions, node.Id, "")
+				h.logger.Error("Error creating node session", "correlation_id", id, "error", err)
+				internal.EncodeError(w, r, diagnostics.AsBadRequestErr(errors.Errorf("[%s] Error creating node session: %w", id, err)))
 				return
 
 			}
@@ -73,94 +118,236 @@ func (h BridgeHandler) Bridge(w http.ResponseWriter, r *http.Request) {
 
 		nodeSession.Connect(r.RemoteAddr)
 
-		go func() {
+		h.metrics.connectedNodes.Inc()
+		h.nodeStatus.touch(node.Id)
+
+		wg.Add(1)
+		go func(nodeId string) {
+			defer wg.Done()
 			defer nodeSession.Disconnect()
+			defer h.metrics.connectedNodes.Dec()
+
+			for {
+				// Backpressure: don't even pull the next request off
+				// RequestCh until this node has a free in-flight slot, so a
+				// slow node stalls its producer instead of growing without
+				// bound.
+				for !dispatcher.tryAdmit(nodeId) {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(50 * time.Millisecond):
+					}
+				}
+
+				var request *erigon_node.NodeRequest
+				select {
+				case <-ctx.Done():
+					dispatcher.release(nodeId)
+					return
+				case req, ok := <-nodeSession.RequestCh:
+					if !ok {
+						dispatcher.release(nodeId)
+						return
+					}
+					request = req
+				}
 
-			for request := range nodeSession.RequestCh {
 				rpcRequest := request.Request
+				id := correlationID(connectionInfo.Sessions, nodeId, rpcRequest.Id)
 
-				bytes, err := json.Marshal(rpcRequest)
+				encoded, err := encodeRPCRequest(useCBOR, rpcRequest)
 
 				if err != nil {
+					dispatcher.release(nodeId)
 					request.Responses <- &erigon_node.Response{
 						Last: true,
 						Error: &erigon_node.Error{
-							Message: fmt.Errorf("Failed to marshal request: %w", err).Error(),
+							Message: fmt.Errorf("[%s] Failed to marshal request: %w", id, err).Error(),
 						},
 					}
 					continue
 				}
 
-				log.Printf("Sending request %s\n", string(bytes))
+				h.logger.Debug("Sending request", "correlation_id", id, "method", rpcRequest.Method)
+
+				timeout := timeoutForMethod(rpcRequest.Method)
+				reqCtx, reqCancel := context.WithTimeout(ctx, timeout)
+				deadline, _ := reqCtx.Deadline()
+
+				dispatcher.add(rpcRequest.Id, &requestEntry{
+					request:   request,
+					nodeId:    nodeId,
+					startedAt: time.Now(),
+					deadline:  deadline,
+					timeout:   timeout,
+					cancel:    reqCancel,
+				})
 
-				requestMutex.Lock()
-				requestMap[rpcRequest.Id] = request
-				requestMutex.Unlock()
+				h.metrics.inFlightRequests.WithLabelValues(nodeId).Inc()
 
-				if _, err := w.Write(bytes); err != nil {
-					requestMutex.Lock()
-					delete(requestMap, rpcRequest.Id)
-					requestMutex.Unlock()
+				writeMu.Lock()
+				err = writeRPCRequest(w, useCBOR, rpcRequest.Id, encoded)
+				if err == nil {
+					flusher.Flush()
+				}
+				writeMu.Unlock()
+
+				if err != nil {
+					dispatcher.remove(rpcRequest.Id)
+					reqCancel()
+					dispatcher.release(nodeId)
+					h.metrics.inFlightRequests.WithLabelValues(nodeId).Dec()
 
 					request.Retries++
-					if request.Retries < 15 {
-						select {
-						case nodeSession.RequestCh <- request:
-						default:
-						}
+					if request.Retries < maxRetries {
+						h.metrics.requestRetries.WithLabelValues(nodeId).Inc()
+						backoff := retryBackoff(request.Retries)
+
+						h.logger.Debug("Retrying", "correlation_id", id, "attempt", request.Retries, "backoff", backoff)
+
+						go func() {
+							select {
+							case <-ctx.Done():
+							case <-time.After(backoff):
+								select {
+								case nodeSession.RequestCh <- request:
+								case <-ctx.Done():
+								}
+							}
+						}()
 					} else {
 						request.Responses <- &erigon_node.Response{
 							Last: true,
 							Error: &erigon_node.Error{
-								Message: fmt.Errorf("Failed to write metrics request: %w", err).Error(),
+								Message: fmt.Errorf("[%s] Failed to write metrics request: %w", id, err).Error(),
 							},
 						}
 					}
 					continue
 				}
-
-				flusher.Flush()
 			}
-		}()
+		}(node.Id)
 	}
 
+	var consecutiveDecodeErrors int
+
+readLoop:
 	for {
-		var response erigon_node.Response
+		select {
+		case <-ctx.Done():
+			break readLoop
+		default:
+		}
+
+		response, err := readRPCResponse(useCBOR, r, frameReader)
 
-		if err = json.NewDecoder(r.Body).Decode(&response); err != nil {
-			log.Printf("Reading response: %v\n", err)
+		if err != nil {
+			h.logger.Warn("Reading response", "error", err)
+
+			consecutiveDecodeErrors++
+			if ctx.Err() != nil || consecutiveDecodeErrors >= maxConsecutiveDecodeErrors {
+				break readLoop
+			}
 			continue
 		}
+		consecutiveDecodeErrors = 0
 
-		requestMutex.Lock()
-		request, ok := requestMap[response.Id]
-		requestMutex.Unlock()
+		entry, ok := dispatcher.get(response.Id)
 
 		if !ok {
+			// Already swept by the janitor as timed out, or never ours.
 			continue
 		}
 
+		id := correlationID(connectionInfo.Sessions, entry.nodeId, response.Id)
+		h.logger.Debug("Response received", "correlation_id", id)
+
+		h.nodeStatus.touch(entry.nodeId)
+		h.metrics.payloadSize.WithLabelValues(entry.nodeId).Observe(float64(len(response.Payload)))
+
 		if response.Error != nil {
 			response.Last = true
 		}
 
-		request.Responses <- &response
+		if !response.Last {
+			// A chunk of a streaming response: the request is actively
+			// progressing, so push its deadline out instead of leaving the
+			// janitor to sweep it mid-stream against the timeout set when
+			// it was first dispatched.
+			dispatcher.refreshDeadline(response.Id, time.Now())
+		}
+
+		// entry.deliver is the single point that decides whether this
+		// response is still wanted: the janitor may have swept entry as
+		// timed out and already delivered its own Last response in the
+		// instant between the dispatcher.get above and here, in which case
+		// nothing is reading entry.request.Responses anymore and a second
+		// send would block forever.
+		if !entry.deliver(response) {
+			continue
+		}
 
 		if response.Last {
-			requestMutex.Lock()
-			delete(requestMap, response.Id)
-			requestMutex.Unlock()
+			dispatcher.remove(response.Id)
+			entry.cancel()
+			dispatcher.release(entry.nodeId)
+
+			h.metrics.inFlightRequests.WithLabelValues(entry.nodeId).Dec()
+			h.metrics.requestDuration.WithLabelValues(entry.nodeId).Observe(time.Since(entry.startedAt).Seconds())
+
+			h.logger.Debug("Last response", "correlation_id", id)
+		}
+	}
+
+	// The reader loop stops once the client has gone away, the server is
+	// shutting down, or maxConsecutiveDecodeErrors reads in a row have
+	// failed, so cancel ctx (harmless if it already is) to unblock the per-node goroutines and
+	// the janitor, then wait for them to actually exit before draining
+	// whatever is left in the dispatcher: those requests will never see a
+	// real response now.
+	cancel()
+	wg.Wait()
+
+	for _, entry := range dispatcher.drain() {
+		if !entry.deliver(&erigon_node.Response{
+			Last: true,
+			Error: &erigon_node.Error{
+				Message: "bridge connection closed",
+			},
+		}) {
+			continue
 		}
+
+		entry.cancel()
+		h.metrics.inFlightRequests.WithLabelValues(entry.nodeId).Dec()
 	}
 }
 
-func NewBridgeHandler(cacheSvc sessions.CacheService) BridgeHandler {
+// NewBridgeHandler builds a BridgeHandler. shutdownCtx is the server-level
+// context that is cancelled when the process is shutting down; every open
+// Bridge connection tears itself down when it fires instead of lingering
+// past the server's own shutdown deadline. logger may be nil, in which case
+// slog.Default() is used.
+func NewBridgeHandler(shutdownCtx context.Context, cacheSvc sessions.CacheService, logger *slog.Logger) BridgeHandler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	registry := prometheus.NewRegistry()
+
 	r := &BridgeHandler{
-		Router: chi.NewRouter(),
-		cache:  cacheSvc,
+		Router:      chi.NewRouter(),
+		cache:       cacheSvc,
+		metrics:     newBridgeMetrics(registry),
+		nodeStatus:  newNodeStatusTracker(),
+		shutdownCtx: shutdownCtx,
+		logger:      logger,
 	}
 
 	r.Post("/", r.Bridge)
+	r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	r.Get("/health", r.Health)
 
 	return *r
 }
@@ -0,0 +1,12 @@
+package api
+
+import "fmt"
+
+// correlationID formats the identifiers that tie one RPC request's
+// lifecycle together across log lines and error responses: the UI
+// sessions attached to the node, the node itself, and the RPC request id.
+// It lets a user filing a bug report be traced end-to-end from the UI
+// through the bridge to the Erigon node.
+func correlationID(sessionIds []string, nodeId, requestId string) string {
+	return fmt.Sprintf("sessions=%v node=%s request=%s", sessionIds, nodeId, requestId)
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/diagnostics/internal/erigon_node"
+)
+
+// defaultRPCTimeout bounds how long the bridge waits for a node to answer
+// an RPC request before giving up on it.
+const defaultRPCTimeout = 30 * time.Second
+
+// methodTimeouts overrides defaultRPCTimeout for RPC methods that are known
+// to take longer than the common case, such as ones that walk the whole
+// database or collect a profile.
+var methodTimeouts = map[string]time.Duration{
+	"flamegraph": 2 * time.Minute,
+	"dbstats":    time.Minute,
+}
+
+func timeoutForMethod(method string) time.Duration {
+	if d, ok := methodTimeouts[method]; ok {
+		return d
+	}
+	return defaultRPCTimeout
+}
+
+// maxInFlightPerNode caps how many RPC requests may be outstanding for a
+// single node at once. Once a node hits the cap, the dispatcher stops
+// pulling further requests off its RequestCh until one completes or times
+// out, so backpressure propagates to whoever is feeding that channel.
+const maxInFlightPerNode = 64
+
+// maxRetries bounds how many times a request is retried after a failed
+// write before the bridge gives up and reports an error.
+const maxRetries = 15
+
+// retryBackoff returns the delay before the n-th retry (n starting at 1),
+// doubling each time up to a ceiling so a persistently broken node isn't
+// hammered with immediate resends.
+func retryBackoff(n int) time.Duration {
+	backoff := 250 * time.Millisecond * time.Duration(uint(1)<<uint(n-1))
+	const max = 10 * time.Second
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// requestEntry is what the dispatcher tracks for every in-flight RPC
+// request: enough to time it out, attribute it to a node, and measure its
+// round-trip latency once the response comes back.
+type requestEntry struct {
+	request   *erigon_node.NodeRequest
+	nodeId    string
+	startedAt time.Time
+	deadline  time.Time
+	timeout   time.Duration // re-applied to deadline on each non-Last response, so an actively streaming request isn't swept as stuck
+	cancel    context.CancelFunc
+
+	mu   sync.Mutex
+	done bool // set once a Last response has been delivered, by whichever of the reader loop or the janitor gets there first
+}
+
+// deliver sends resp on the entry's Responses channel, unless the entry has
+// already received its Last response — from the node, or as a timeout
+// delivered by the janitor. Without this gate, the reader loop and the
+// janitor can race on the same request (one has it mid-flight while the
+// other has just declared it timed out): both would try to send, but
+// Responses is only read until the first Last arrives, so the loser's send
+// would block forever instead of being a harmless no-op.
+func (e *requestEntry) deliver(resp *erigon_node.Response) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.done {
+		return false
+	}
+	if resp.Last {
+		e.done = true
+	}
+
+	e.request.Responses <- resp
+	return true
+}
+
+// requestDispatcher tracks in-flight requests for a single Bridge
+// connection. It enforces a per-node in-flight cap and lets a janitor
+// sweep out requests that have exceeded their deadline, replacing the
+// unbounded map and busy-retry loop the bridge used to rely on.
+type requestDispatcher struct {
+	mu       sync.Mutex
+	entries  map[string]*requestEntry
+	inFlight map[string]int
+	metrics  *bridgeMetrics
+}
+
+func newRequestDispatcher(metrics *bridgeMetrics) *requestDispatcher {
+	return &requestDispatcher{
+		entries:  map[string]*requestEntry{},
+		inFlight: map[string]int{},
+		metrics:  metrics,
+	}
+}
+
+// tryAdmit reserves an in-flight slot for nodeId, returning false if the
+// node is already at maxInFlightPerNode.
+func (d *requestDispatcher) tryAdmit(nodeId string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.inFlight[nodeId] >= maxInFlightPerNode {
+		return false
+	}
+	d.inFlight[nodeId]++
+	return true
+}
+
+func (d *requestDispatcher) release(nodeId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight[nodeId]--
+}
+
+func (d *requestDispatcher) add(id string, entry *requestEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[id] = entry
+}
+
+func (d *requestDispatcher) get(id string) (*requestEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[id]
+	return e, ok
+}
+
+func (d *requestDispatcher) remove(id string) (*requestEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[id]
+	if ok {
+		delete(d.entries, id)
+	}
+	return e, ok
+}
+
+// refreshDeadline pushes id's deadline out to now plus its configured
+// timeout, provided it is still tracked. It is called for every non-Last
+// response an entry receives, so a request that keeps streaming chunks
+// (a flamegraph or dbstats snapshot, or anything the node takes a while to
+// fully emit) stays alive as long as it keeps making progress, instead of
+// being swept by the janitor mid-stream against the deadline set when it
+// was first dispatched.
+func (d *requestDispatcher) refreshDeadline(id string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[id]; ok {
+		e.deadline = now.Add(e.timeout)
+	}
+}
+
+// drain removes and returns every entry still tracked by the dispatcher. It
+// is used once the bridge connection itself is going away and none of
+// these requests will ever see a real response.
+func (d *requestDispatcher) drain() []*requestEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries := make([]*requestEntry, 0, len(d.entries))
+	for id, e := range d.entries {
+		entries = append(entries, e)
+		delete(d.entries, id)
+	}
+	return entries
+}
+
+// sweepExpired removes and returns every entry whose deadline has passed.
+func (d *requestDispatcher) sweepExpired(now time.Time) []*requestEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var expired []*requestEntry
+	for id, e := range d.entries {
+		if now.After(e.deadline) {
+			expired = append(expired, e)
+			delete(d.entries, id)
+		}
+	}
+	return expired
+}
+
+// runJanitor periodically sweeps expired requests, delivering a timeout
+// response to each and freeing its in-flight slot, until ctx is done.
+func (d *requestDispatcher) runJanitor(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, e := range d.sweepExpired(now) {
+					d.timeoutEntry(e)
+				}
+			}
+		}
+	}()
+}
+
+// timeoutEntry delivers a timeout response for an entry the janitor swept
+// out for exceeding its deadline. If the reader loop has, in the same
+// instant, delivered a real Last response for this entry, deliver reports
+// false and timeoutEntry does nothing further: the reader loop already did
+// the cancel/release/metrics bookkeeping for it.
+func (d *requestDispatcher) timeoutEntry(e *requestEntry) {
+	delivered := e.deliver(&erigon_node.Response{
+		Last: true,
+		Error: &erigon_node.Error{
+			Message: "timed out waiting for node response",
+		},
+	})
+
+	if !delivered {
+		return
+	}
+
+	e.cancel()
+	d.release(e.nodeId)
+	d.metrics.inFlightRequests.WithLabelValues(e.nodeId).Dec()
+}
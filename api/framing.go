@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ledgerwatch/diagnostics/internal/erigon_node"
+)
+
+// cborContentType is the Content-Type a node sends on the initial connect
+// request to opt into the framed binary transport instead of the legacy
+// newline-free JSON objects. Any other (or missing) Content-Type keeps the
+// bridge on the JSON path.
+const cborContentType = "application/vnd.erigon.diag.v2+cbor"
+
+// frameVersion is bumped whenever the wire frame below changes shape in a
+// backward-incompatible way.
+const frameVersion = 1
+
+// frameHeaderSize is the size, in bytes, of the big-endian length prefix
+// that precedes every CBOR-encoded frame on the wire.
+const frameHeaderSize = 4
+
+// maxFrameSize bounds how large a single frame's payload may be, guarding
+// against a corrupt length prefix turning into an unbounded allocation.
+const maxFrameSize = 64 << 20 // 64MiB
+
+// frame is the unit of exchange on the binary transport: a request or a
+// response, correlated by Id the same way the JSON transport does, with
+// Payload carrying the CBOR-encoded request or response body. Framing it
+// explicitly (rather than relying on concatenated top-level CBOR values,
+// the way the JSON path relies on concatenated JSON objects) lets large
+// payloads like flame graphs or DB stats stream without the decoder ever
+// having to guess where one value ends and the next begins. readFrame
+// checks Version against frameVersion so a node running a mismatched
+// build is rejected outright rather than being fed through a decoder that
+// doesn't understand its frame shape; it does not resync a stream that's
+// lost synchronization from a corrupt length prefix, the same as the JSON
+// path can't resync from a corrupt object boundary.
+type frame struct {
+	Version uint8  `cbor:"1,keyasint"`
+	Id      string `cbor:"2,keyasint"`
+	Last    bool   `cbor:"3,keyasint"`
+	Payload []byte `cbor:"4,keyasint"`
+}
+
+// isCBORTransport reports whether the node negotiated the framed binary
+// transport for this connection. The Content-Type header is parsed rather
+// than compared verbatim, so a node that appends a parameter (for example
+// "; charset=binary") still lands on the CBOR path instead of silently
+// falling back to JSON and desyncing the connection.
+func isCBORTransport(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == cborContentType
+}
+
+// writeFrame CBOR-encodes f and writes it to w as a length-prefixed frame.
+func writeFrame(w io.Writer, f frame) error {
+	body, err := cbor.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshal frame: %w", err)
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return fmt.Errorf("write frame header: %w", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("write frame body: %w", err)
+	}
+
+	return nil
+}
+
+// readFrame reads and CBOR-decodes the next length-prefixed frame from r.
+// A length prefix larger than maxFrameSize is rejected before the body is
+// read or allocated; a prefix within that bound is trusted as is.
+func readFrame(r *bufio.Reader) (frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, fmt.Errorf("read frame header: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return frame{}, fmt.Errorf("frame size %d exceeds maximum %d", size, maxFrameSize)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return frame{}, fmt.Errorf("read frame body: %w", err)
+	}
+
+	var f frame
+	if err := cbor.Unmarshal(body, &f); err != nil {
+		return frame{}, fmt.Errorf("unmarshal frame: %w", err)
+	}
+
+	if f.Version != frameVersion {
+		return frame{}, fmt.Errorf("unsupported frame version %d, want %d", f.Version, frameVersion)
+	}
+
+	return f, nil
+}
+
+// encodeRPCRequest marshals rpcRequest for the wire, using CBOR when
+// useCBOR is set and JSON otherwise. The returned bytes are the payload
+// that writeRPCRequest later puts on the wire; callers that need to log
+// the outgoing request should do so before framing, since a CBOR payload
+// isn't human-readable.
+func encodeRPCRequest(useCBOR bool, rpcRequest *erigon_node.Request) ([]byte, error) {
+	if useCBOR {
+		return cbor.Marshal(rpcRequest)
+	}
+	return json.Marshal(rpcRequest)
+}
+
+// writeRPCRequest puts an already-encoded request on the wire, framing it
+// when useCBOR is set.
+func writeRPCRequest(w io.Writer, useCBOR bool, id string, encoded []byte) error {
+	if useCBOR {
+		return writeFrame(w, frame{Version: frameVersion, Id: id, Payload: encoded})
+	}
+
+	_, err := w.Write(encoded)
+	return err
+}
+
+// decodeHandshake reads the connection handshake sent at the start of a
+// Bridge connection, using the same transport negotiated for the rest of
+// the connection: a CBOR-encoded frame when useCBOR is set, or a plain
+// JSON object otherwise.
+func decodeHandshake(useCBOR bool, r *http.Request, frameReader *bufio.Reader, v interface{}) error {
+	if useCBOR {
+		f, err := readFrame(frameReader)
+		if err != nil {
+			return err
+		}
+		return cbor.Unmarshal(f.Payload, v)
+	}
+
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// readRPCResponse reads the next response from the node, decoding a CBOR
+// frame via frameReader when useCBOR is set, or the next JSON object from
+// r.Body otherwise.
+func readRPCResponse(useCBOR bool, r *http.Request, frameReader *bufio.Reader) (*erigon_node.Response, error) {
+	if useCBOR {
+		f, err := readFrame(frameReader)
+		if err != nil {
+			return nil, err
+		}
+
+		var response erigon_node.Response
+		if err := cbor.Unmarshal(f.Payload, &response); err != nil {
+			return nil, fmt.Errorf("unmarshal response payload: %w", err)
+		}
+		response.Id = f.Id
+		response.Last = f.Last
+
+		return &response, nil
+	}
+
+	var response erigon_node.Response
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
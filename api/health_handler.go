@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type nodeHealth struct {
+	NodeId   string    `json:"nodeId"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type healthResponse struct {
+	Status string       `json:"status"`
+	Nodes  []nodeHealth `json:"nodes"`
+}
+
+// Health reports bridge liveness together with the last-seen timestamp of
+// every node that has talked to this bridge instance, so that a stuck
+// Erigon connection shows up without having to scrape logs.
+func (h BridgeHandler) Health(w http.ResponseWriter, r *http.Request) {
+	lastSeen := h.nodeStatus.snapshot()
+
+	resp := healthResponse{
+		Status: "ok",
+		Nodes:  make([]nodeHealth, 0, len(lastSeen)),
+	}
+
+	for nodeId, ts := range lastSeen {
+		resp.Nodes = append(resp.Nodes, nodeHealth{NodeId: nodeId, LastSeen: ts})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bridgeMetrics holds the Prometheus collectors published by BridgeHandler.
+// All per-node series are labelled with the Erigon node id (NodeInfo.Id) so
+// that a single bridge instance serving many nodes still yields actionable
+// per-node dashboards.
+type bridgeMetrics struct {
+	connectedNodes   prometheus.Gauge
+	activeSessions   prometheus.Gauge
+	inFlightRequests *prometheus.GaugeVec
+	requestRetries   *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	payloadSize      *prometheus.HistogramVec
+}
+
+func newBridgeMetrics(reg *prometheus.Registry) *bridgeMetrics {
+	m := &bridgeMetrics{
+		connectedNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "connected_nodes",
+			Help:      "Number of Erigon nodes currently connected to the bridge.",
+		}),
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "active_sessions",
+			Help:      "Number of bridge connections currently open.",
+		}),
+		inFlightRequests: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "inflight_requests",
+			Help:      "Number of RPC requests awaiting a response, per node.",
+		}, []string{"node_id"}),
+		requestRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "request_retries_total",
+			Help:      "Number of times a request had to be retried before it was written, per node.",
+		}, []string{"node_id"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "request_duration_seconds",
+			Help:      "Round-trip latency of an RPC request, from the moment it is written until the last response arrives.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"node_id"}),
+		payloadSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "diagnostics",
+			Subsystem: "bridge",
+			Name:      "response_payload_bytes",
+			Help:      "Size of response payloads received from nodes.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+		}, []string{"node_id"}),
+	}
+
+	reg.MustRegister(
+		m.connectedNodes,
+		m.activeSessions,
+		m.inFlightRequests,
+		m.requestRetries,
+		m.requestDuration,
+		m.payloadSize,
+	)
+
+	return m
+}
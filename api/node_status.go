@@ -0,0 +1,38 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// nodeStatusTracker records, per node id, the last time the bridge heard
+// from that node. It backs the /health endpoint so operators can spot a
+// stuck Erigon connection without having to scrape logs.
+type nodeStatusTracker struct {
+	mu       sync.RWMutex
+	lastSeen map[string]time.Time
+}
+
+func newNodeStatusTracker() *nodeStatusTracker {
+	return &nodeStatusTracker{
+		lastSeen: map[string]time.Time{},
+	}
+}
+
+func (t *nodeStatusTracker) touch(nodeId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSeen[nodeId] = time.Now()
+}
+
+func (t *nodeStatusTracker) snapshot() map[string]time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make(map[string]time.Time, len(t.lastSeen))
+	for id, ts := range t.lastSeen {
+		out[id] = ts
+	}
+
+	return out
+}